@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// File is the subset of *os.File that the migrator needs once a write has
+// been opened through a FileSystem.
+type File interface {
+	io.Writer
+	io.Closer
+	Sync() error
+}
+
+// FileSystem abstracts the filesystem operations used by the migrator so
+// that copyFile, createSiaDir, renameAll, deleteEmptyDirs, and
+// recurviseDelete can run against production disk or an in-memory
+// implementation, in the spirit of afero's Fs interface. This lets tests
+// exercise the full migration without touching os.TempDir, and lets
+// downstream callers plug in read-only or dry-run FileSystems of their
+// own.
+type FileSystem interface {
+	// Stat returns the FileInfo for name, following symlinks.
+	Stat(name string) (os.FileInfo, error)
+	// Lstat returns the FileInfo for name, without following symlinks.
+	Lstat(name string) (os.FileInfo, error)
+	// ReadFile reads the entire contents of name.
+	ReadFile(name string) ([]byte, error)
+	// ReadDir reads the directory named by dirname and returns a list of
+	// directory entries sorted by filename.
+	ReadDir(dirname string) ([]os.FileInfo, error)
+	// WriteFile writes data to name, creating it if necessary.
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	// MkdirAll creates path, along with any necessary parents.
+	MkdirAll(path string, perm os.FileMode) error
+	// Remove removes name.
+	Remove(name string) error
+	// Rename renames oldpath to newpath, replacing newpath if it already
+	// exists and is not a directory.
+	Rename(oldpath, newpath string) error
+	// Chmod changes the mode of name.
+	Chmod(name string, mode os.FileMode) error
+	// SyncDir fsyncs the directory at name, so that prior renames or
+	// removes of its entries are durable before it returns.
+	SyncDir(name string) error
+	// Walk walks the file tree rooted at root, calling walkFn for each
+	// file or directory in the tree, including root.
+	Walk(root string, walkFn filepath.WalkFunc) error
+	// OpenFile opens name with the given flags and permissions, creating
+	// it if the flags include os.O_CREATE.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+}
+
+// OSFileSystem implements FileSystem by calling directly through to the os
+// and ioutil packages. It is the FileSystem used in production.
+type OSFileSystem struct{}
+
+// Stat implements FileSystem.Stat.
+func (OSFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// Lstat implements FileSystem.Lstat.
+func (OSFileSystem) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+// ReadFile implements FileSystem.ReadFile.
+func (OSFileSystem) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+// ReadDir implements FileSystem.ReadDir.
+func (OSFileSystem) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dirname)
+}
+
+// WriteFile implements FileSystem.WriteFile.
+func (OSFileSystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(name, data, perm)
+}
+
+// MkdirAll implements FileSystem.MkdirAll.
+func (OSFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+// Remove implements FileSystem.Remove.
+func (OSFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// Rename implements FileSystem.Rename.
+func (OSFileSystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// Chmod implements FileSystem.Chmod.
+func (OSFileSystem) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+// SyncDir implements FileSystem.SyncDir.
+func (OSFileSystem) SyncDir(name string) error {
+	d, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Walk implements FileSystem.Walk.
+func (OSFileSystem) Walk(root string, walkFn filepath.WalkFunc) error {
+	return filepath.Walk(root, walkFn)
+}
+
+// OpenFile implements FileSystem.OpenFile.
+func (OSFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
@@ -1,21 +1,95 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"gitlab.com/NebulousLabs/Sia/modules"
 	"gitlab.com/NebulousLabs/Sia/modules/renter/filesystem/siadir"
 	"gitlab.com/NebulousLabs/errors"
-	"gitlab.com/NebulousLabs/fastrand"
 )
 
+// journalPath is the name of the newline-delimited JSON journal file that
+// records the progress of a migration, making it resumable and idempotent.
+const journalPath = "dirpaths"
+
+// journalStatus records the state of a single renameAll journal entry.
+type journalStatus string
+
+const (
+	// journalStatusInProgress marks an entry whose copy has started but is
+	// not yet confirmed complete.
+	journalStatusInProgress journalStatus = "in-progress"
+	// journalStatusDone marks an entry whose copy completed and whose
+	// original was removed.
+	journalStatusDone journalStatus = "done"
+)
+
+// journalEntry records the migration of a single siafile so that an
+// interrupted run can be resumed without leaving duplicate or orphaned
+// copies on disk.
+type journalEntry struct {
+	OldPath       string        `json:"oldPath"`
+	NewPath       string        `json:"newPath"`
+	Extended      bool          `json:"extended"`
+	SiaDirCreated bool          `json:"siaDirCreated"`
+	Status        journalStatus `json:"status"`
+}
+
+// loadJournal reads the newline-delimited JSON journal at path and returns
+// its entries indexed by OldPath. A missing journal is treated as empty.
+func loadJournal(fs FileSystem, path string) (map[string]journalEntry, error) {
+	entries := make(map[string]journalEntry)
+	data, err := fs.ReadFile(path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, errors.AddContext(err, "unable to read journal")
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var entry journalEntry
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.AddContext(err, "unable to decode journal entry")
+		}
+		entries[entry.OldPath] = entry
+	}
+	return entries, nil
+}
+
+// writeJournalEntry appends entry to the journal as a single line of JSON
+// and fsyncs the journal file, so a "done" entry rollback relies on can
+// never be lost to a crash after it's been written but before it's durable.
+func writeJournalEntry(f File, entry journalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return errors.AddContext(err, "unable to marshal journal entry")
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return errors.AddContext(err, "unable to write journal entry")
+	}
+	return f.Sync()
+}
+
 const (
 	// dirDepth and dirLength are used to define the desired filesystem structure.
 	//
@@ -25,28 +99,91 @@ const (
 	dirLength = 2
 )
 
-var (
-	dirs = make(map[string]struct{})
-)
-
-// copyFile will copy a file on disk to a new location and remove the old file
-func copyFile(oldPath, newPath string) error {
+// tmpSuffix is appended to newPath to build the temporary file copyFile
+// writes to before renaming it into place.
+const tmpSuffix = ".tmp"
+
+// copyFile copies a file on disk to a new location and removes the old file,
+// crash-safely. It writes to a tmp sibling of newPath, fsyncs the file,
+// renames the tmp file into place, fsyncs newPath's parent directory, and
+// only then removes oldPath, fsyncing oldPath's parent too. This way a power loss
+// mid-migration never leaves a half-written destination, and never loses the
+// source before the destination is durable on disk. It returns the number of
+// bytes copied so callers can report copy progress.
+func copyFile(fs FileSystem, oldPath, newPath string) (int64, error) {
 	// Read data from file at old path
-	data, err := ioutil.ReadFile(oldPath)
+	data, err := fs.ReadFile(oldPath)
 	if err != nil {
-		return errors.AddContext(err, "ioutil.ReadFile failed")
+		return 0, errors.AddContext(err, "fs.ReadFile failed")
+	}
+
+	// Write the data to a tmp file next to newPath, removing any tmp file
+	// left behind by a prior, interrupted attempt before claiming the name
+	// with O_EXCL.
+	tmpPath := newPath + tmpSuffix
+	if err := fs.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return 0, errors.AddContext(err, "unable to remove stale tmp file")
 	}
-	// Write to new extended file path
-	err = ioutil.WriteFile(newPath, data, modules.DefaultFilePerm)
+	file, err := fs.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, modules.DefaultFilePerm)
 	if err != nil {
-		return errors.AddContext(err, "ioutil.WriteFile failed")
+		return 0, errors.AddContext(err, "fs.OpenFile failed")
 	}
-	// Remove old extended file path
-	err = os.Remove(oldPath)
+	n, err := file.Write(data)
 	if err != nil {
-		return errors.AddContext(err, "os.Remove failed failed")
+		return 0, errors.Compose(errors.AddContext(err, "unable to write tmp file"), file.Close())
 	}
-	return nil
+	if n != len(data) {
+		return 0, errors.Compose(fmt.Errorf("write was only applied partially - %v / %v", n, len(data)), file.Close())
+	}
+	if err := file.Sync(); err != nil {
+		return 0, errors.Compose(errors.AddContext(err, "unable to sync tmp file"), file.Close())
+	}
+	if err := file.Close(); err != nil {
+		return 0, errors.AddContext(err, "unable to close tmp file")
+	}
+	// Rename the tmp file into place, then remove the old file. Either
+	// directory may have had its write bit stripped, so go through
+	// inWritableDir.
+	newDir := filepath.Dir(newPath)
+	err = inWritableDir(fs, newDir, func() error {
+		return fs.Rename(tmpPath, newPath)
+	})
+	if err != nil {
+		return 0, errors.AddContext(err, "unable to rename tmp file into place")
+	}
+	if err := fs.SyncDir(newDir); err != nil {
+		return 0, errors.AddContext(err, "unable to sync new parent dir")
+	}
+	oldDir := filepath.Dir(oldPath)
+	err = inWritableDir(fs, oldDir, func() error {
+		return fs.Remove(oldPath)
+	})
+	if err != nil {
+		return 0, errors.AddContext(err, "unable to remove old file")
+	}
+	if err := fs.SyncDir(oldDir); err != nil {
+		return 0, errors.AddContext(err, "unable to sync old parent dir")
+	}
+	return int64(len(data)), nil
+}
+
+// inWritableDir calls fn with dir guaranteed to be writable, temporarily
+// chmod'ing it +w if necessary and restoring its original mode on exit - the
+// same trick syncthing's inWritableDir uses so that a rename or remove
+// inside dir doesn't fail just because the directory isn't writable.
+func inWritableDir(fs FileSystem, dir string, fn func() error) error {
+	fi, err := fs.Stat(dir)
+	if err != nil {
+		return errors.AddContext(err, "unable to stat dir")
+	}
+	mode := fi.Mode()
+	if mode&0200 == 0 {
+		if err := fs.Chmod(dir, mode|0200); err != nil {
+			return errors.AddContext(err, "unable to make dir writable")
+		}
+		defer fs.Chmod(dir, mode)
+	}
+	return fn()
 }
 
 // deleteEmptyDirs will walk the filesystem and delete an empty directories. It
@@ -54,8 +191,11 @@ func copyFile(oldPath, newPath string) error {
 // directory, then that directory should be deleted as well.
 //
 // NOTE: a directory that only contains a .siadir file is considered empty
-func deleteEmptyDirs(root string) error {
-	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+func deleteEmptyDirs(ctx context.Context, fs FileSystem, root string) error {
+	return fs.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
 		// Check if fi is nil, this happens when the .siadir is deleted from the
 		// directory and walk expects to visit it next
 		if fi == nil {
@@ -67,81 +207,105 @@ func deleteEmptyDirs(root string) error {
 		}
 
 		// Recursively delete empty directories
-		return recurviseDelete(path)
+		return recurviseDelete(ctx, fs, path)
 	})
 }
 
+// Options configures a call to Run.
+type Options struct {
+	NumWorkers     int
+	FollowSymlinks bool
+}
+
+// Run performs a full migration of root: renaming every siafile into the
+// 2/2/2/26 structure and then deleting any directories left empty. It
+// respects ctx - a canceled ctx stops the walk and the worker pool promptly,
+// between files rather than mid-copy, leaving the journal in a resumable
+// state so the migration can be continued later.
+func Run(ctx context.Context, root string, opts Options) error {
+	fs := OSFileSystem{}
+	if err := renameAll(ctx, fs, root, opts.NumWorkers, opts.FollowSymlinks); err != nil {
+		return err
+	}
+	return deleteEmptyDirs(ctx, fs, root)
+}
+
 func main() {
 	// Check input args
-	args := os.Args
+	numWorkers := flag.Int("workers", runtime.NumCPU(), "number of parallel workers used to copy siafiles")
+	followSymlinks := flag.Bool("follow-symlinks", false, "copy through symlinks instead of skipping them")
+	flag.Parse()
+	args := flag.Args()
 	fmt.Println(args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	switch len(args) {
-	case 1:
+	case 0:
 		fmt.Println("Executing Rename and Delete")
-	case 2:
-		if args[1] != "delete-only" {
+	case 1:
+		switch args[0] {
+		case "delete-only":
+			fmt.Println("Executing Delete Only")
+			err := deleteEmptyDirs(ctx, OSFileSystem{}, "./fs/var/skynet")
+			if err != nil {
+				println("error deleting dirs", err)
+				os.Exit(1)
+			}
+			println("Deletion Done")
+		case "rollback":
+			fmt.Println("Executing Rollback")
+			err := rollback(ctx, OSFileSystem{})
+			if err != nil {
+				println("error rolling back", err)
+				os.Exit(1)
+			}
+			println("Rollback Done")
+		default:
 			panic("Improper use")
 		}
-		fmt.Println("Executing Delete Only")
-		err := deleteEmptyDirs("./fs/var/skynet")
-		if err != nil {
-			println("error deleting dirs", err)
-			os.Exit(1)
-		}
-		println("Deletion Done")
 		return
 	default:
 		panic("Improper use")
 	}
 
-	// Open file to track directory paths
-	f, err := os.OpenFile("dirpaths", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		println("error creating dirpath file", err)
-		os.Exit(1)
-	}
-	defer func() {
-		if err := f.Close(); err != nil {
-			println(err)
-		}
-	}()
-
-	// Rename Files
-	err = renameAll(f, "./fs/var/skynet")
-	if err != nil {
-		println("error renaming files", err)
-		os.Exit(1)
-	}
-
-	// Go back over the file system and delete any empty directories
-	err = deleteEmptyDirs("./fs/var/skynet")
-	if err != nil {
-		println("error deleting dirs", err)
+	opts := Options{NumWorkers: *numWorkers, FollowSymlinks: *followSymlinks}
+	if err := Run(ctx, "./fs/var/skynet", opts); err != nil {
+		println("error running migration", err)
 		os.Exit(1)
 	}
 }
 
-// randomName returns a random file name following a 2/2/2/26 structure
-func randomName() string {
-	b := hex.EncodeToString((fastrand.Bytes(16)))
+// hashName derives a deterministic 2/2/2/26 path from the sha256 hash of
+// relPath, so that repeated runs of the migration against the same tree
+// always produce the same destination for a given source file. This is what
+// makes the migration resumable and idempotent: re-running it never assigns
+// a file a different new home.
+func hashName(relPath string) string {
+	sum := sha256.Sum256([]byte(relPath))
+	h := hex.EncodeToString(sum[:])
 	str := ""
 	for i := 0; i < dirDepth; i++ {
 		if i == 0 {
-			str = fmt.Sprintf("%s", b[:dirLength])
+			str = fmt.Sprintf("%s", h[:dirLength])
 			continue
 		}
-		str = fmt.Sprintf("%s/%s", str, b[dirLength*i:dirLength*(i+1)])
+		str = fmt.Sprintf("%s/%s", str, h[dirLength*i:dirLength*(i+1)])
 	}
-	str = fmt.Sprintf("%s/%s", str, b[dirLength*dirDepth:])
+	str = fmt.Sprintf("%s/%s", str, h[dirLength*dirDepth:dirLength*dirDepth+26])
 	return str
 }
 
 // recurviseDelete will delete all directories for a given path that are empty
 // starting with the lowest level child directory
-func recurviseDelete(path string) error {
+func recurviseDelete(ctx context.Context, fs FileSystem, path string) error {
 	for path != "." && path != "/" {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		// Read directory
-		fileinfos, err := ioutil.ReadDir(path)
+		fileinfos, err := fs.ReadDir(path)
 		if err != nil {
 			return errors.AddContext(err, fmt.Sprintf("unable to read dir %s", path))
 		}
@@ -156,14 +320,14 @@ func recurviseDelete(path string) error {
 			}
 			siadir := filepath.Join(path, fi.Name())
 			// Attempt to delete the .siadir file
-			err = os.Remove(siadir)
+			err = fs.Remove(siadir)
 			if err != nil && !os.IsNotExist(err) {
 				return errors.AddContext(err, fmt.Sprintf("unable to remove siadir %s", siadir))
 			}
 		}
 
 		// Delete empty directory
-		err = os.Remove(path)
+		err = fs.Remove(path)
 		if err != nil {
 			return errors.AddContext(err, fmt.Sprintf("unable to remove path %s", path))
 		}
@@ -175,10 +339,10 @@ func recurviseDelete(path string) error {
 }
 
 // createSiaDir creates a siadir on disk if there is not one present
-func createSiaDir(dir string) error {
+func createSiaDir(fs FileSystem, dir string) error {
 	path := filepath.Join(dir, modules.SiaDirExtension)
 	// Check for existing siadir
-	_, err := os.Stat(path)
+	_, err := fs.Stat(path)
 	if !os.IsNotExist(err) {
 		return nil
 	}
@@ -207,7 +371,7 @@ func createSiaDir(dir string) error {
 	}
 
 	// Write the data to disk and sync
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0600)
+	file, err := fs.OpenFile(path, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0600)
 	if err != nil {
 		return err
 	}
@@ -227,99 +391,406 @@ func createSiaDir(dir string) error {
 
 }
 
+// renameProgress tracks and reports progress for a running migration: how
+// many of the known siafiles have been handled, how many bytes have been
+// copied, and (from those two) a files/sec rate and a rough ETA.
+type renameProgress struct {
+	mu          sync.Mutex
+	start       time.Time
+	totalFiles  int64
+	filesDone   int64
+	bytesCopied int64
+}
+
+// newRenameProgress returns a renameProgress tracking totalFiles files,
+// starting its rate calculation from now.
+func newRenameProgress(totalFiles int64) *renameProgress {
+	return &renameProgress{start: time.Now(), totalFiles: totalFiles}
+}
+
+// addFile records that one more file, consisting of bytesCopied bytes, has
+// been handled.
+func (p *renameProgress) addFile(bytesCopied int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.filesDone++
+	p.bytesCopied += bytesCopied
+}
+
+// snapshot returns the current progress numbers along with a files/sec rate
+// and an ETA for the remaining files, computed from that rate.
+func (p *renameProgress) snapshot() (filesDone, totalFiles, bytesCopied int64, filesPerSec float64, eta time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	elapsed := time.Since(p.start).Seconds()
+	if elapsed > 0 {
+		filesPerSec = float64(p.filesDone) / elapsed
+	}
+	if filesPerSec > 0 && p.totalFiles > p.filesDone {
+		eta = time.Duration(float64(p.totalFiles-p.filesDone)/filesPerSec) * time.Second
+	}
+	return p.filesDone, p.totalFiles, p.bytesCopied, filesPerSec, eta
+}
+
+// report prints a progress line on a fixed interval until stop is closed.
+func (p *renameProgress) report(stop <-chan struct{}) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			filesDone, totalFiles, bytesCopied, filesPerSec, eta := p.snapshot()
+			fmt.Printf("progress: %d/%d files, %.1f files/sec, %d bytes copied, ETA %s\n",
+				filesDone, totalFiles, filesPerSec, bytesCopied, eta.Round(time.Second))
+		case <-stop:
+			return
+		}
+	}
+}
+
 // renameAll will walk the filesystem and rename all files to create a directory
-// structure that follows a 2/2/2/26 pattern
-func renameAll(f *os.File, root string) error {
-	totalFiles := 0
-	// Loop over files and rename them
-	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
-		// Ignore non siafiles and dirs.
-		ext := filepath.Ext(fi.Name())
-		if ext != modules.SiaFileExtension {
-			return nil
+// structure that follows a 2/2/2/26 pattern. The destination for each file
+// is derived deterministically from its path, and progress is recorded in
+// the journal so an interrupted run can be resumed: entries marked done are
+// skipped, and in-progress entries are reconciled against what's actually on
+// disk rather than blindly re-copied.
+//
+// A single filepath.Walk producer feeds candidate siafile paths to a pool of
+// numWorkers workers, which perform the actual copy/journal work in
+// parallel. The dirs map and the journal file are shared mutable state, so
+// they're protected by a mutex and serialized through a dedicated writer
+// goroutine, respectively.
+//
+// Walk reports FileInfo via Lstat, so symlinks are never followed into
+// directories. When followSymlinks is false, symlinked siafiles are skipped
+// entirely rather than copied, so the migration never copies a file from
+// outside root.
+//
+// A canceled ctx stops the producer walk and every worker promptly, between
+// files rather than mid-copy, and is checked in every filepath.Walk callback
+// and before every copyFile call.
+func renameAll(ctx context.Context, fs FileSystem, root string, numWorkers int, followSymlinks bool) error {
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	entries, err := loadJournal(fs, journalPath)
+	if err != nil {
+		return errors.AddContext(err, "unable to load journal")
+	}
+	journalFile, err := fs.OpenFile(journalPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return errors.AddContext(err, "unable to open journal")
+	}
+	defer func() {
+		if cerr := journalFile.Close(); cerr != nil {
+			fmt.Println("unable to close journal", cerr)
 		}
-		if fi.IsDir() {
+	}()
+
+	// totalFiles is a quick, read-only pass so the progress reporter has
+	// something to compute an ETA against.
+	var totalFiles int64
+	err = fs.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 && !followSymlinks {
 			return nil
 		}
-		totalFiles++
-		if totalFiles%1000 == 0 {
-			println(totalFiles, "files handled")
+		if !fi.IsDir() && filepath.Ext(fi.Name()) == modules.SiaFileExtension {
+			totalFiles++
 		}
-		// Ignore files already in the 2/2/2/<filename> structure
-		dirStructure := strings.TrimPrefix(path, root)
-		if validDirStructure(dirStructure) {
-			// Verify there is a siadir in this directory
-			dir := filepath.Dir(path)
-			return createSiaDir(dir)
+		return nil
+	})
+	if err != nil {
+		return errors.AddContext(err, "unable to count files")
+	}
+
+	// journalWrites serializes every append to the journal through a single
+	// dedicated goroutine so concurrent workers never interleave partial
+	// lines in the file.
+	journalWrites := make(chan journalEntry, numWorkers)
+	journalDone := make(chan struct{})
+	go func() {
+		defer close(journalDone)
+		for entry := range journalWrites {
+			if err := writeJournalEntry(journalFile, entry); err != nil {
+				fmt.Println("unable to write journal entry", err)
+			}
 		}
+	}()
+
+	progress := newRenameProgress(totalFiles)
+	stopProgress := make(chan struct{})
+	progressDone := make(chan struct{})
+	go func() {
+		defer close(progressDone)
+		progress.report(stopProgress)
+	}()
 
-		// Log Original name
-		name := strings.TrimSuffix(path, modules.SiaFileExtension)
+	// dirs tracks which destination directories this invocation has already
+	// created, so it must live and die with this call - not be a package
+	// global, or a later call against a different (possibly brand-new)
+	// FileSystem would see stale hits for the same relative paths and skip
+	// MkdirAll/createSiaDir entirely.
+	dirs := make(map[string]struct{})
+	var dirsMu sync.Mutex
+	var errOnce sync.Once
+	var firstErr error
+	setErr := func(err error) {
+		errOnce.Do(func() { firstErr = err })
+	}
 
-		// Ignore extended files
-		if strings.HasSuffix(name, "-extended") {
+	jobs := make(chan string, numWorkers)
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				bytesCopied, err := renameFile(ctx, fs, root, path, entries, journalWrites, dirs, &dirsMu, followSymlinks)
+				if err != nil {
+					setErr(errors.AddContext(err, fmt.Sprintf("unable to rename %s", path)))
+					continue
+				}
+				progress.addFile(bytesCopied)
+			}
+		}()
+	}
+
+	// Producer: walk the tree once and hand every candidate siafile to the
+	// worker pool.
+	walkErr := fs.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 && !followSymlinks {
+			fmt.Println("skipping symlink", path)
+			return nil
+		}
+		if fi.IsDir() || filepath.Ext(fi.Name()) != modules.SiaFileExtension {
 			return nil
 		}
+		jobs <- path
+		return nil
+	})
+	close(jobs)
+	wg.Wait()
+	close(journalWrites)
+	<-journalDone
+	close(stopProgress)
+	<-progressDone
+
+	if walkErr != nil {
+		return walkErr
+	}
+	return firstErr
+}
 
-		// Determine new paths
-		newName := randomName() + modules.SiaFileExtension
-		newPath := filepath.Join(root, newName)
-		oldPathExtended := strings.TrimSuffix(name, modules.SiaFileExtension) + "-extended" + modules.SiaFileExtension
-		newPathExtended := strings.TrimSuffix(newPath, modules.SiaFileExtension) + "-extended" + modules.SiaFileExtension
+// renameFile migrates a single siafile discovered by renameAll's walk -
+// renaming it to its deterministic destination, copying its -extended
+// counterpart if present, and recording progress in the journal - and
+// returns the number of bytes copied. dirs tracks which destination
+// directories this renameAll call has already created, and dirsMu guards
+// it, since both are shared across every worker.
+func renameFile(ctx context.Context, fs FileSystem, root, path string, entries map[string]journalEntry, journalWrites chan<- journalEntry, dirs map[string]struct{}, dirsMu *sync.Mutex, followSymlinks bool) (int64, error) {
+	// Ignore files already in the 2/2/2/<filename> structure, just verify
+	// there is a siadir in their directory.
+	dirStructure := strings.TrimPrefix(path, root)
+	if validDirStructure(dirStructure) {
+		return 0, createSiaDir(fs, filepath.Dir(path))
+	}
 
-		// Check if this is a new directory
-		dir := filepath.Dir(newPath)
-		_, exists := dirs[dir]
-		if !exists {
-			// Write name to dirpath file
-			_, err = f.WriteString(dir + "\n")
-			if err != nil {
-				fmt.Println("unable to write dir to file", dir)
-			}
+	// Ignore extended files; they're picked up alongside their siafile.
+	name := strings.TrimSuffix(path, modules.SiaFileExtension)
+	if strings.HasSuffix(name, "-extended") {
+		return 0, nil
+	}
 
-			// Create directory
-			err = os.MkdirAll(dir, modules.DefaultDirPerm)
+	// Determine new paths
+	newName := hashName(dirStructure) + modules.SiaFileExtension
+	newPath := filepath.Join(root, newName)
+	oldPathExtended := strings.TrimSuffix(name, modules.SiaFileExtension) + "-extended" + modules.SiaFileExtension
+	newPathExtended := strings.TrimSuffix(newPath, modules.SiaFileExtension) + "-extended" + modules.SiaFileExtension
+
+	// If the journal already confirms this file done, skip it. If it's
+	// in-progress, check whether a prior run actually finished the copy
+	// before deciding to redo it.
+	entry, resuming := entries[path]
+	if resuming {
+		if entry.NewPath != newPath {
+			return 0, fmt.Errorf("journal entry for %s points at %s, expected %s; refusing to proceed", path, entry.NewPath, newPath)
+		}
+		if entry.Status == journalStatusDone {
+			return 0, nil
+		}
+		_, oldErr := fs.Stat(path)
+		_, newErr := fs.Stat(newPath)
+		if oldErr == nil && newErr == nil {
+			// The copy finished on a previous run but the original was
+			// never removed and/or the journal was never updated. Finish
+			// the job instead of re-copying.
+			err := inWritableDir(fs, filepath.Dir(path), func() error {
+				return fs.Remove(path)
+			})
 			if err != nil {
-				return errors.AddContext(err, "os.MkdirAll  failed")
+				return 0, errors.AddContext(err, "unable to remove original while resuming")
 			}
+			entry.Status = journalStatusDone
+			journalWrites <- entry
+			return 0, nil
+		}
+	}
 
-			// Create a SiaDir file
-			err = createSiaDir(dir)
-			if err != nil {
-				return errors.AddContext(err, "createSiaDir  failed")
-			}
+	// Check if this is a new directory. dirsMu is held across the whole
+	// check-and-create, not just the map update, so a second worker hashing
+	// into the same directory can't see it marked "created" and race ahead
+	// to copyFile before MkdirAll/createSiaDir have actually run.
+	dir := filepath.Dir(newPath)
+	dirsMu.Lock()
+	_, dirExists := dirs[dir]
+	dirs[dir] = struct{}{}
+	siaDirCreated := false
+	if !dirExists {
+		// Create directory
+		if err := fs.MkdirAll(dir, modules.DefaultDirPerm); err != nil {
+			dirsMu.Unlock()
+			return 0, errors.AddContext(err, "fs.MkdirAll  failed")
 		}
 
-		// Add to dirs map, it is fine if we are overwriting an existing entry
-		dirs[dir] = struct{}{}
+		// Create a SiaDir file
+		if err := createSiaDir(fs, dir); err != nil {
+			dirsMu.Unlock()
+			return 0, errors.AddContext(err, "createSiaDir  failed")
+		}
+		siaDirCreated = true
+	}
+	dirsMu.Unlock()
 
-		// Ignore edge case that file exists are new location
-		if path == newPath {
-			return nil
+	// Ignore edge case that file exists are new location
+	if path == newPath {
+		return 0, nil
+	}
+
+	// Refuse to silently overwrite a target that isn't this file's own
+	// destination from a previous, interrupted run.
+	if !resuming {
+		if _, err := fs.Stat(newPath); err == nil {
+			return 0, fmt.Errorf("refusing to overwrite existing file at %s", newPath)
 		}
+	}
 
-		// Copy the siafile
-		err = copyFile(path, newPath)
-		if err != nil {
-			return errors.AddContext(err, "copyFile  failed")
+	entry = journalEntry{
+		OldPath:       path,
+		NewPath:       newPath,
+		SiaDirCreated: siaDirCreated,
+		Status:        journalStatusInProgress,
+	}
+	journalWrites <- entry
+
+	// Copy the siafile
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	bytesCopied, err := copyFile(fs, path, newPath)
+	if err != nil {
+		return 0, errors.AddContext(err, "copyFile  failed")
+	}
+
+	// If there is an extended file, copy it too. Lstat, not Stat, so a
+	// dangling or symlinked -extended.sia is never silently resolved to an
+	// unrelated file.
+	extFi, err := fs.Lstat(oldPathExtended)
+	if err != nil && !os.IsNotExist(err) {
+		return bytesCopied, errors.AddContext(err, "fs.Lstat for extended failed")
+	}
+	if err == nil {
+		if extFi.Mode()&os.ModeSymlink != 0 && !followSymlinks {
+			fmt.Println("skipping symlinked extended file", oldPathExtended)
+		} else {
+			if err := ctx.Err(); err != nil {
+				return bytesCopied, err
+			}
+			entry.Extended = true
+			extBytes, err := copyFile(fs, oldPathExtended, newPathExtended)
+			if err != nil {
+				return bytesCopied, errors.AddContext(err, "copyFile for extended failed")
+			}
+			bytesCopied += extBytes
 		}
+	}
 
-		// If there is not an extended file we are done
-		_, err = os.Stat(oldPathExtended)
-		if os.IsNotExist(err) {
-			return nil
+	entry.Status = journalStatusDone
+	journalWrites <- entry
+	return bytesCopied, nil
+}
+
+// rollback reverses a completed migration using the dirpaths journal: for
+// every entry recorded as done, it moves NewPath (and its -extended
+// counterpart, if any) back to OldPath, recreating whatever intermediate
+// directories OldPath needs, and cleans up the now-empty 2/2/2 directory
+// with recurviseDelete. Entries that are still in-progress are left alone,
+// since renameFile hasn't confirmed where their data actually lives. The
+// journal entries carry full paths, so rollback needs no root of its own.
+func rollback(ctx context.Context, fs FileSystem) error {
+	entries, err := loadJournal(fs, journalPath)
+	if err != nil {
+		return errors.AddContext(err, "unable to load journal")
+	}
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-		if err != nil {
-			return errors.AddContext(err, "os.Stat for extended failed")
+		if entry.Status != journalStatusDone {
+			continue
+		}
+		if err := rollbackEntry(ctx, fs, entry); err != nil {
+			return errors.AddContext(err, fmt.Sprintf("unable to roll back %s", entry.OldPath))
 		}
+	}
+	return nil
+}
 
-		// Copy the extended file
-		err = copyFile(oldPathExtended, newPathExtended)
-		if err != nil {
-			return errors.AddContext(err, "copyFile for extended failed")
+// rollbackEntry reverses a single completed journalEntry.
+func rollbackEntry(ctx context.Context, fs FileSystem, entry journalEntry) error {
+	oldDir := filepath.Dir(entry.OldPath)
+	if err := fs.MkdirAll(oldDir, modules.DefaultDirPerm); err != nil {
+		return errors.AddContext(err, "fs.MkdirAll failed")
+	}
+	// deleteEmptyDirs may have removed oldDir's .siadir along with the
+	// directory itself during migration; recreate it so rollback restores a
+	// healthy directory, not just the file.
+	if err := createSiaDir(fs, oldDir); err != nil {
+		return errors.AddContext(err, "unable to recreate siadir")
+	}
+	newDir := filepath.Dir(entry.NewPath)
+
+	move := func(newPath, oldPath string) error {
+		return inWritableDir(fs, newDir, func() error {
+			return inWritableDir(fs, oldDir, func() error {
+				return fs.Rename(newPath, oldPath)
+			})
+		})
+	}
+	if err := move(entry.NewPath, entry.OldPath); err != nil {
+		return errors.AddContext(err, "unable to move file back to oldPath")
+	}
+
+	if entry.Extended {
+		oldPathExtended := strings.TrimSuffix(entry.OldPath, modules.SiaFileExtension) + "-extended" + modules.SiaFileExtension
+		newPathExtended := strings.TrimSuffix(entry.NewPath, modules.SiaFileExtension) + "-extended" + modules.SiaFileExtension
+		if err := move(newPathExtended, oldPathExtended); err != nil {
+			return errors.AddContext(err, "unable to move extended file back to oldPath")
 		}
-		return nil
-	})
+	}
+
+	return recurviseDelete(ctx, fs, newDir)
 }
 
 // validDirStructure returns a boolean indicating if the path is of the
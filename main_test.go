@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -52,10 +54,13 @@ func TestCopyFile(t *testing.T) {
 
 	// Copy file to a new destination
 	newname := filepath.Join(testDir, "newname.dat")
-	err = copyFile(name, newname)
+	n, err := copyFile(OSFileSystem{}, name, newname)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if n != int64(len(data)) {
+		t.Fatal("bad byte count", n)
+	}
 
 	// Read file at new destination and verify data
 	newData, err := ioutil.ReadFile(newname)
@@ -65,15 +70,32 @@ func TestCopyFile(t *testing.T) {
 	if !bytes.Equal(data, newData) {
 		t.Fatal("bad")
 	}
+
+	// The original file should be gone, and no .tmp file should be left
+	// behind.
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Fatal("old file still exists", err)
+	}
+	if _, err := os.Stat(newname + tmpSuffix); !os.IsNotExist(err) {
+		t.Fatal("tmp file still exists", err)
+	}
 }
 
-// TestRandomName tests the random name generation satisfies the
-// validDirStructure
-func TestRandomName(t *testing.T) {
+// TestHashName tests that the hashed name generation satisfies
+// validDirStructure and is deterministic.
+func TestHashName(t *testing.T) {
 	for i := 0; i < 1000; i++ {
-		if !validDirStructure(randomName()) {
-			t.Fatal("bad")
+		relPath := fmt.Sprintf("/home/user/siafiles/file%d.sia", i)
+		name := hashName(relPath)
+		if !validDirStructure(name) {
+			t.Fatal("bad", name)
 		}
+		if hashName(relPath) != name {
+			t.Fatal("hashName is not deterministic", relPath)
+		}
+	}
+	if hashName("/a/file.sia") == hashName("/b/file.sia") {
+		t.Fatal("different paths hashed to the same name")
 	}
 }
 
@@ -88,7 +110,7 @@ func TestRecursiveDelete(t *testing.T) {
 	}
 
 	// Delete the directory tree and verify it is removed from disk
-	err = recurviseDelete(path)
+	err = recurviseDelete(context.Background(), OSFileSystem{}, path)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -116,7 +138,7 @@ func TestRecursiveDelete(t *testing.T) {
 
 	// Delete the directory tree and verify that only the expected directories
 	// were deleted
-	err = recurviseDelete(path)
+	err = recurviseDelete(context.Background(), OSFileSystem{}, path)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -167,9 +189,11 @@ func TestValidDirStructure(t *testing.T) {
 // TestRenameAllAndDelete tests the full implementation of renaming an entire
 // directory system and deleting the empty directories
 func TestRenameAllAndDelete(t *testing.T) {
-	// Create a testing directory and directory system
-	testDir := tempDir(t.Name())
-	fileDir := filepath.Join(testDir, "files")
+	// Create an in-memory filesystem and directory system. Using a
+	// memFileSystem instead of real files lets this test run without
+	// touching os.TempDir.
+	fs := newMemFileSystem()
+	fileDir := "/files"
 	files := []string{
 		filepath.Join(fileDir, "file.sia"),
 		filepath.Join(fileDir, "file2.sia"),
@@ -185,66 +209,86 @@ func TestRenameAllAndDelete(t *testing.T) {
 		filepath.Join(fileDir, "a/.siadir"),
 		filepath.Join(fileDir, "a/a/a/.siadir"),
 	}
-	goodFile := filepath.Join(fileDir, "bb/bb/file.sia")
-	err := os.MkdirAll(filepath.Dir(goodFile), persist.DefaultDiskPermissionsTest)
+	goodFile := filepath.Join(fileDir, "bb/bb/bb/file.sia")
+	err := fs.MkdirAll(filepath.Dir(goodFile), persist.DefaultDiskPermissionsTest)
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = os.Create(goodFile)
+	err = fs.WriteFile(goodFile, nil, persist.DefaultDiskPermissionsTest)
 	if err != nil {
 		t.Fatal(err)
 	}
 	for _, file := range files {
-		err = os.MkdirAll(filepath.Dir(file), persist.DefaultDiskPermissionsTest)
+		err = fs.MkdirAll(filepath.Dir(file), persist.DefaultDiskPermissionsTest)
 		if err != nil {
 			t.Fatal(err)
 		}
-		_, err = os.Create(file)
+		err = fs.WriteFile(file, nil, persist.DefaultDiskPermissionsTest)
 		if err != nil {
 			t.Fatal(err)
 		}
 	}
 	for _, siadir := range siadirs {
-		err = os.MkdirAll(filepath.Dir(siadir), persist.DefaultDiskPermissionsTest)
+		err = fs.MkdirAll(filepath.Dir(siadir), persist.DefaultDiskPermissionsTest)
 		if err != nil {
 			t.Fatal(err)
 		}
-		_, err = os.Create(siadir)
+		err = fs.WriteFile(siadir, nil, persist.DefaultDiskPermissionsTest)
 		if err != nil {
 			t.Fatal(err)
 		}
 	}
 
+	// Seed a symlink inside fileDir that points at a file outside of it, and
+	// verify the migrator never follows it.
+	outsideFile := "/outside/secret.sia"
+	err = fs.MkdirAll(filepath.Dir(outsideFile), persist.DefaultDiskPermissionsTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.WriteFile(outsideFile, []byte("secret"), persist.DefaultDiskPermissionsTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	symlink := filepath.Join(fileDir, "link.sia")
+	err = fs.Symlink(outsideFile, symlink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	// rename files
-	dirFile := filepath.Join(testDir, "File")
-	f, err := os.Create(dirFile)
+	err = renameAll(context.Background(), fs, fileDir, 4, false)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer func() {
-		if err := f.Close(); err != nil {
-			t.Fatal(err)
-		}
-	}()
-	err = renameAll(f, fileDir)
+
+	// The symlink should have been skipped, not followed: the outside file
+	// is untouched and the symlink itself is still sitting where it was.
+	outsideData, err := fs.ReadFile(outsideFile)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if string(outsideData) != "secret" {
+		t.Fatal("outside file was modified", string(outsideData))
+	}
+	if _, err := fs.Lstat(symlink); err != nil {
+		t.Fatal("symlink should have been left in place", err)
+	}
 
 	// Verify renaming
-	_, err = os.Stat(goodFile)
+	_, err = fs.Stat(goodFile)
 	if err != nil {
 		t.Fatal(err)
 	}
 	for _, file := range files {
-		_, err = os.Stat(file)
+		_, err = fs.Stat(file)
 		if !os.IsNotExist(err) {
 			t.Fatal(err, file)
 		}
 	}
 
 	// Delete all the empty dirs
-	err = deleteEmptyDirs(fileDir)
+	err = deleteEmptyDirs(context.Background(), fs, fileDir)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -254,26 +298,71 @@ func TestRenameAllAndDelete(t *testing.T) {
 		if dir == fileDir {
 			continue
 		}
-		_, err = os.Stat(dir)
+		_, err = fs.Stat(dir)
 		if !os.IsNotExist(err) {
 			t.Fatal(err, dir)
 		}
 	}
 	for _, siadir := range siadirs {
-		_, err = os.Stat(siadir)
+		_, err = fs.Stat(siadir)
 		if !os.IsNotExist(err) {
 			t.Fatal(err, siadir)
 		}
 	}
 }
 
+// TestRollback tests that rollback reverses a completed migration using the
+// dirpaths journal.
+func TestRollback(t *testing.T) {
+	fs := newMemFileSystem()
+	fileDir := "/files"
+	files := []string{
+		filepath.Join(fileDir, "file.sia"),
+		filepath.Join(fileDir, "file2.sia"),
+		filepath.Join(fileDir, "file3.sia"),
+		filepath.Join(fileDir, "file3-extended.sia"),
+		filepath.Join(fileDir, "a/file.sia"),
+	}
+	for _, file := range files {
+		err := fs.MkdirAll(filepath.Dir(file), persist.DefaultDiskPermissionsTest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fs.WriteFile(file, []byte(file), persist.DefaultDiskPermissionsTest)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Migrate, then roll the migration back.
+	err := renameAll(context.Background(), fs, fileDir, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rollback(context.Background(), fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every original file should be back, with its original contents.
+	for _, file := range files {
+		data, err := fs.ReadFile(file)
+		if err != nil {
+			t.Fatal(err, file)
+		}
+		if string(data) != file {
+			t.Fatal("bad data after rollback", file, string(data))
+		}
+	}
+}
+
 // TestCreateSiaDir tests the createSiaDir function
 func TestCreateSiaDir(t *testing.T) {
 	// Create test directory
 	testDir := tempDir(t.Name())
 
 	// Make a siadir on disk
-	err := createSiaDir(testDir)
+	err := createSiaDir(OSFileSystem{}, testDir)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -331,7 +420,7 @@ func TestCreateSiaDir(t *testing.T) {
 	md = siadir.Metadata{}
 
 	// verify a call to createSiaDir is a no-op
-	err = createSiaDir(testDir)
+	err = createSiaDir(OSFileSystem{}, testDir)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memFileSystem is an in-memory FileSystem implementation used by tests so
+// that the migrator can be exercised without touching os.TempDir.
+type memFileSystem struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode
+}
+
+// memNode is a single file, directory, or symlink tracked by a
+// memFileSystem.
+type memNode struct {
+	isDir     bool
+	isSymlink bool
+	target    string
+	data      []byte
+	mode      os.FileMode
+	modTime   time.Time
+}
+
+// newMemFileSystem returns an initialized memFileSystem containing just the
+// root directory.
+func newMemFileSystem() *memFileSystem {
+	return &memFileSystem{
+		nodes: map[string]*memNode{
+			".": {isDir: true, mode: os.ModeDir | 0755},
+		},
+	}
+}
+
+// memFileInfo implements os.FileInfo for a path tracked by a memFileSystem.
+type memFileInfo struct {
+	name string
+	node *memNode
+}
+
+// Name implements os.FileInfo.
+func (fi memFileInfo) Name() string { return fi.name }
+
+// Size implements os.FileInfo.
+func (fi memFileInfo) Size() int64 { return int64(len(fi.node.data)) }
+
+// Mode implements os.FileInfo.
+func (fi memFileInfo) Mode() os.FileMode {
+	if fi.node.isDir {
+		return os.ModeDir | fi.node.mode
+	}
+	if fi.node.isSymlink {
+		return os.ModeSymlink | fi.node.mode
+	}
+	return fi.node.mode
+}
+
+// ModTime implements os.FileInfo.
+func (fi memFileInfo) ModTime() time.Time { return fi.node.modTime }
+
+// IsDir implements os.FileInfo.
+func (fi memFileInfo) IsDir() bool { return fi.node.isDir }
+
+// Sys implements os.FileInfo.
+func (fi memFileInfo) Sys() interface{} { return nil }
+
+// memFile implements File for a file opened through a memFileSystem.
+type memFile struct {
+	fs   *memFileSystem
+	name string
+	perm os.FileMode
+	buf  bytes.Buffer
+}
+
+// Write implements File.Write.
+func (f *memFile) Write(p []byte) (int, error) {
+	return f.buf.Write(p)
+}
+
+// Sync implements File.Sync.
+func (f *memFile) Sync() error { return nil }
+
+// Close implements File.Close, committing the buffered data to the
+// memFileSystem.
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.fs.nodes[f.name] = &memNode{
+		data:    f.buf.Bytes(),
+		mode:    f.perm,
+		modTime: time.Now(),
+	}
+	return nil
+}
+
+// clean normalizes a path the way the os package would before using it as a
+// map key.
+func clean(name string) string {
+	return filepath.Clean(name)
+}
+
+// Stat implements FileSystem.Stat, following symlinks.
+func (fs *memFileSystem) Stat(name string) (os.FileInfo, error) {
+	name = clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	base := filepath.Base(name)
+	const maxLinks = 10
+	for i := 0; i < maxLinks; i++ {
+		node, ok := fs.nodes[name]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		if !node.isSymlink {
+			return memFileInfo{name: base, node: node}, nil
+		}
+		name = clean(node.target)
+	}
+	return nil, errors.New("too many levels of symbolic links: " + base)
+}
+
+// Lstat implements FileSystem.Lstat, without following a final symlink.
+func (fs *memFileSystem) Lstat(name string) (os.FileInfo, error) {
+	return fs.lstat(name)
+}
+
+func (fs *memFileSystem) lstat(name string) (os.FileInfo, error) {
+	name = clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	node, ok := fs.nodes[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return memFileInfo{name: filepath.Base(name), node: node}, nil
+}
+
+// Symlink creates a symlink at newname pointing at oldname. It isn't part of
+// the FileSystem interface - the migrator itself never creates symlinks -
+// but tests need it to build trees that exercise symlink handling.
+func (fs *memFileSystem) Symlink(oldname, newname string) error {
+	newname = clean(newname)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if parent, ok := fs.nodes[filepath.Dir(newname)]; !ok || !parent.isDir {
+		return os.ErrNotExist
+	}
+	fs.nodes[newname] = &memNode{isSymlink: true, target: oldname, mode: 0777, modTime: time.Now()}
+	return nil
+}
+
+// ReadFile implements FileSystem.ReadFile.
+func (fs *memFileSystem) ReadFile(name string) ([]byte, error) {
+	name = clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	node, ok := fs.nodes[name]
+	if !ok || node.isDir {
+		return nil, os.ErrNotExist
+	}
+	data := make([]byte, len(node.data))
+	copy(data, node.data)
+	return data, nil
+}
+
+// ReadDir implements FileSystem.ReadDir.
+func (fs *memFileSystem) ReadDir(dirname string) ([]os.FileInfo, error) {
+	dirname = clean(dirname)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if node, ok := fs.nodes[dirname]; !ok || !node.isDir {
+		return nil, os.ErrNotExist
+	}
+	var infos []os.FileInfo
+	for path, node := range fs.nodes {
+		if path == dirname || filepath.Dir(path) != dirname {
+			continue
+		}
+		infos = append(infos, memFileInfo{name: filepath.Base(path), node: node})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// WriteFile implements FileSystem.WriteFile.
+func (fs *memFileSystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	name = clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if parent, ok := fs.nodes[filepath.Dir(name)]; !ok || !parent.isDir {
+		return os.ErrNotExist
+	}
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	fs.nodes[name] = &memNode{data: buf, mode: perm, modTime: time.Now()}
+	return nil
+}
+
+// MkdirAll implements FileSystem.MkdirAll.
+func (fs *memFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	path = clean(path)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, dir := range parents(path) {
+		if node, ok := fs.nodes[dir]; ok {
+			if !node.isDir {
+				return errors.New("not a directory: " + dir)
+			}
+			continue
+		}
+		fs.nodes[dir] = &memNode{isDir: true, mode: os.ModeDir | perm, modTime: time.Now()}
+	}
+	return nil
+}
+
+// parents returns path and every parent directory of path, ordered from the
+// root down to path itself.
+func parents(path string) []string {
+	var dirs []string
+	for path != "." && path != "/" && path != "" {
+		dirs = append([]string{path}, dirs...)
+		path = filepath.Dir(path)
+	}
+	return append([]string{"."}, dirs...)
+}
+
+// Remove implements FileSystem.Remove.
+func (fs *memFileSystem) Remove(name string) error {
+	name = clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.nodes[name]; !ok {
+		return os.ErrNotExist
+	}
+	for path := range fs.nodes {
+		if path != name && filepath.Dir(path) == name {
+			return errors.New("directory not empty: " + name)
+		}
+	}
+	delete(fs.nodes, name)
+	return nil
+}
+
+// Rename implements FileSystem.Rename.
+func (fs *memFileSystem) Rename(oldpath, newpath string) error {
+	oldpath = clean(oldpath)
+	newpath = clean(newpath)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	node, ok := fs.nodes[oldpath]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if parent, ok := fs.nodes[filepath.Dir(newpath)]; !ok || !parent.isDir {
+		return os.ErrNotExist
+	}
+	fs.nodes[newpath] = node
+	delete(fs.nodes, oldpath)
+	return nil
+}
+
+// Chmod implements FileSystem.Chmod.
+func (fs *memFileSystem) Chmod(name string, mode os.FileMode) error {
+	name = clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	node, ok := fs.nodes[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if node.isDir {
+		node.mode = os.ModeDir | mode
+	} else {
+		node.mode = mode
+	}
+	return nil
+}
+
+// SyncDir implements FileSystem.SyncDir. memFileSystem keeps no on-disk
+// directory entries to fsync, so this is a no-op once name is confirmed to
+// be a directory that exists.
+func (fs *memFileSystem) SyncDir(name string) error {
+	name = clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	node, ok := fs.nodes[name]
+	if !ok || !node.isDir {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// OpenFile implements FileSystem.OpenFile.
+func (fs *memFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = clean(name)
+	fs.mu.Lock()
+	node, exists := fs.nodes[name]
+	if exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+		fs.mu.Unlock()
+		return nil, os.ErrExist
+	}
+	if !exists && flag&os.O_CREATE == 0 {
+		fs.mu.Unlock()
+		return nil, os.ErrNotExist
+	}
+	if !exists {
+		if parent, ok := fs.nodes[filepath.Dir(name)]; !ok || !parent.isDir {
+			fs.mu.Unlock()
+			return nil, os.ErrNotExist
+		}
+	}
+	f := &memFile{fs: fs, name: name, perm: perm}
+	if exists && flag&os.O_APPEND != 0 {
+		f.buf.Write(node.data)
+	}
+	fs.mu.Unlock()
+	return f, nil
+}
+
+// Walk implements FileSystem.Walk, visiting root and all of its descendants
+// in the same order filepath.Walk would.
+func (fs *memFileSystem) Walk(root string, walkFn filepath.WalkFunc) error {
+	root = clean(root)
+	fi, err := fs.lstat(root)
+	if err != nil {
+		return walkFn(root, nil, err)
+	}
+	return fs.walk(root, fi, walkFn)
+}
+
+func (fs *memFileSystem) walk(path string, fi os.FileInfo, walkFn filepath.WalkFunc) error {
+	if !fi.IsDir() {
+		return walkFn(path, fi, nil)
+	}
+
+	// Read the directory's entries before invoking walkFn, matching
+	// filepath.Walk's own order - otherwise a walkFn that deletes path (or
+	// one of its ancestors) as a side effect of being visited, like
+	// recurviseDelete does, would make this ReadDir fail on an entry that
+	// real Walk had already captured and wouldn't have revisited.
+	children, err := fs.ReadDir(path)
+	err1 := walkFn(path, fi, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+
+	for _, child := range children {
+		childPath := filepath.Join(path, child.Name())
+		if err := fs.walk(childPath, child, walkFn); err != nil {
+			return err
+		}
+	}
+	return nil
+}